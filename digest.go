@@ -1,8 +1,17 @@
 package auth
 
 import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
 	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
 	"fmt"
+	"hash/fnv"
+	"io"
 	"net/http"
 	"net/url"
 	"sort"
@@ -11,21 +20,103 @@ import (
 	"sync"
 	"time"
 
+	"github.com/golang/groupcache/lru"
 	"golang.org/x/net/context"
 )
 
+func md5sum(data string) string {
+	h := md5.New()
+	io.WriteString(h, data)
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+func sha256sum(data string) string {
+	h := sha256.New()
+	io.WriteString(h, data)
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+func sha512_256sum(data string) string {
+	h := sha512.New512_256()
+	io.WriteString(h, data)
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// algorithms maps the RFC 7616 algorithm tokens this package understands
+// to their underlying hash function. The "-SESS" variants share the hash
+// function of their base algorithm; CheckAuth special-cases the "-SESS"
+// suffix when deriving HA1.
+var algorithms = map[string]func(data string) string{
+	"MD5":              md5sum,
+	"MD5-SESS":         md5sum,
+	"SHA-256":          sha256sum,
+	"SHA-256-SESS":     sha256sum,
+	"SHA-512-256":      sha512_256sum,
+	"SHA-512-256-SESS": sha512_256sum,
+}
+
 type digest_client struct {
 	nc        uint64
 	last_seen int64
 }
 
 type DigestAuth struct {
-	Algorithm        string
+	// Algorithms advertised to clients, strongest first. Each entry
+	// produces its own "WWW-Authenticate: Digest ..." header (RFC 7616
+	// §3.7), letting modern clients pick SHA-256 or SHA-512-256 while
+	// older clients fall back to MD5. Defaults to []string{"MD5"}.
+	Algorithms       []string
 	Realm            string
 	Opaque           string
 	Secrets          SecretProvider
 	PlainTextSecrets bool
 	IgnoreNonceCount bool
+	// PasswordVerifier, if set, is used instead of Secrets/PlainTextSecrets
+	// to authenticate against a bcrypt/argon2 (or similar) password hash.
+	// See PasswordVerifier and VerifyPassword.
+	PasswordVerifier PasswordVerifier
+	// HA1Cache holds HA1 digests derived by PasswordVerifier, keyed by
+	// (user, realm, algorithm) -- HA1 depends on the negotiated hash
+	// function, and Algorithms may advertise more than one simultaneously.
+	// Defaults to NewHA1Cache() in NewDigestAuthenticator; only consulted
+	// when PasswordVerifier is set. See HA1Cache for the security
+	// tradeoff of backing it with anything but process memory.
+	HA1Cache HA1Cache
+	// HA1CacheTTL bounds how long an HA1Cache entry stays valid after
+	// VerifyPassword warms it. Zero means entries never expire. Once an
+	// entry expires, checkAuth reports stale=true until VerifyPassword is
+	// called again.
+	HA1CacheTTL time.Duration
+	// Users enumerates every valid username for Realm. It is only
+	// required to accept userhash=true requests (RFC 7616 §3.6), where
+	// the Authorization header carries H(username:realm) instead of the
+	// plaintext username and the server must recover it by comparison.
+	Users []string
+	// Nonces issues and validates nonces. Defaults to an
+	// InMemoryNonceSource backed by Store, so behavior is unchanged
+	// unless it is replaced with a SignedNonceSource. See NonceSource.
+	Nonces NonceSource
+	// NonceCounters tracks the nonce-count (nc) replay window
+	// independently of how the nonce itself was issued. Defaults to da
+	// itself, which defers to Store. See NonceCounterStore.
+	NonceCounters NonceCounterStore
+	// Store tracks every nonce this server has issued or accepted,
+	// keyed by the nonce itself. Defaults to the sharded store returned
+	// by NewClientStore; NewLRUClientStore provides a strict-LRU
+	// alternative. See ClientStore.
+	Store ClientStore
+	// QOP lists the quality-of-protection values advertised to clients,
+	// rendered as e.g. qop="auth,auth-int". Defaults to []string{"auth"};
+	// add "auth-int" to additionally verify request body integrity (RFC
+	// 7616 §3.4.3), which requires buffering the body up to
+	// MaxAuthIntBodySize.
+	QOP []string
+	// MaxAuthIntBodySize bounds how much of the request body CheckAuth
+	// will buffer to verify a qop=auth-int request. Requests whose body
+	// exceeds this are rejected with 413 Request Entity Too Large rather
+	// than buffered without limit. Ignored unless QOP includes
+	// "auth-int".
+	MaxAuthIntBodySize int64
 	// Headers used by authenticator. Set to ProxyHeaders to use with
 	// proxy server. When nil, NormalHeaders are used.
 	Headers *Headers
@@ -39,13 +130,263 @@ type DigestAuth struct {
 	ClientCacheSize      int
 	ClientCacheTolerance int
 
-	clients map[string]*digest_client
-	mutex   sync.RWMutex
+	// userhashIndex caches, per algorithm, the H(user:realm) -> user
+	// reverse lookup lookupUserhash needs for userhash=true requests, so
+	// it is built at most once per algorithm instead of being recomputed
+	// by rehashing every entry in Users on every such request.
+	userhashIndexMu sync.Mutex
+	userhashIndex   map[string]map[string]string
 }
 
 // check that DigestAuth implements AuthenticatorInterface
 var _ = (AuthenticatorInterface)((*DigestAuth)(nil))
 
+// NonceSource issues digest nonces and validates previously issued ones.
+// The default InMemoryNonceSource keeps every issued nonce in memory, so
+// it is forgotten (forcing re-authentication) on process restart.
+// SignedNonceSource instead makes the nonce self-verifying, so it
+// survives restarts and needs no storage shared across instances.
+//
+// When Validate rejects an authentic nonce only because it has expired,
+// it returns the nonce's issue time with ok=false; for a forged or
+// unknown nonce it returns the zero time. checkAuth reports stale=true
+// only in the first case.
+type NonceSource interface {
+	Issue() string
+	Validate(nonce string) (issuedAt time.Time, ok bool)
+}
+
+// InMemoryNonceSource reproduces the historical behavior of DigestAuth: a
+// nonce is valid exactly as long as it remains in da.Store, as added by
+// Issue and pruned by da.Purge.
+type InMemoryNonceSource struct {
+	da *DigestAuth
+}
+
+func (s *InMemoryNonceSource) Issue() string {
+	nonce := RandomKey()
+	s.da.Store.Add(nonce)
+	return nonce
+}
+
+func (s *InMemoryNonceSource) Validate(nonce string) (time.Time, bool) {
+	_, lastSeen, ok := s.da.Store.Get(nonce)
+	if !ok {
+		return time.Time{}, false
+	}
+	return lastSeen, true
+}
+
+// SignedNonceSource issues stateless nonces of the form
+// base64(timestamp || HMAC(timestamp || opaque || Secret)), following the
+// approach used by e.g. the Haskell hdigest library. Validate needs no
+// shared storage, which lets digest sessions survive restarts and scale
+// across instances; replay protection for nonce-count is left to
+// NonceCounterStore.
+type SignedNonceSource struct {
+	// Secret signs issued nonces. Keep it stable across restarts and
+	// instances that must accept each other's nonces; anyone who learns
+	// it can forge fresh-looking nonces.
+	Secret []byte
+	// MaxAge bounds how long an issued nonce stays valid. Zero means
+	// nonces never expire.
+	MaxAge time.Duration
+	// Opaque binds issued nonces to a particular realm/server instance.
+	// NewDigestAuthenticator leaves this to be filled in by callers that
+	// construct a SignedNonceSource themselves.
+	Opaque string
+}
+
+func (s *SignedNonceSource) sign(timestamp int64) []byte {
+	mac := hmac.New(sha256.New, s.Secret)
+	fmt.Fprintf(mac, "%d:%s", timestamp, s.Opaque)
+	return mac.Sum(nil)
+}
+
+func (s *SignedNonceSource) Issue() string {
+	timestamp := time.Now().UnixNano()
+	mac := s.sign(timestamp)
+	raw := make([]byte, 8+len(mac))
+	binary.BigEndian.PutUint64(raw, uint64(timestamp))
+	copy(raw[8:], mac)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func (s *SignedNonceSource) Validate(nonce string) (time.Time, bool) {
+	raw, err := base64.RawURLEncoding.DecodeString(nonce)
+	if err != nil || len(raw) <= 8 {
+		return time.Time{}, false
+	}
+	timestamp := int64(binary.BigEndian.Uint64(raw[:8]))
+	if !hmac.Equal(raw[8:], s.sign(timestamp)) {
+		return time.Time{}, false
+	}
+	issuedAt := time.Unix(0, timestamp)
+	if s.MaxAge > 0 && time.Since(issuedAt) > s.MaxAge {
+		return issuedAt, false
+	}
+	return issuedAt, true
+}
+
+// NonceCounterStore tracks the highest nonce-count (nc) seen for a given
+// nonce, which is how DigestAuth rejects replayed requests, independently
+// of how the nonce itself was issued and validated. The default is
+// DigestAuth itself, which defers to Store; callers needing replay
+// protection shared across instances (e.g. a Redis-backed store) can
+// supply their own.
+type NonceCounterStore interface {
+	Get(nonce string) (nc uint64, ok bool)
+	Update(nonce string, nc uint64)
+}
+
+// Get implements NonceCounterStore by deferring to Store.
+func (da *DigestAuth) Get(nonce string) (nc uint64, ok bool) {
+	nc, _, ok = da.Store.Get(nonce)
+	return
+}
+
+// Update implements NonceCounterStore by deferring to Store.
+func (da *DigestAuth) Update(nonce string, nc uint64) {
+	da.Store.Update(nonce, nc)
+}
+
+// ClientStore tracks every nonce DigestAuth has issued or accepted,
+// together with the highest nonce-count (nc) seen for it. It is the
+// single source of truth client bookkeeping is built on: InMemoryNonceSource
+// and the default NonceCounterStore (DigestAuth itself) both defer to it.
+//
+// The default store, from NewClientStore, shards its state across
+// several sync.Mutex-guarded buckets rather than the single sync.RWMutex
+// DigestAuth used to hold across request handling — which had produced
+// concurrent-map-write panics in downstream forks. NewLRUClientStore
+// provides a strict-LRU alternative backed by groupcache/lru for callers
+// who want eviction on every insert rather than periodic purging.
+type ClientStore interface {
+	// Get reports the last-seen nonce-count and time for nonce.
+	Get(nonce string) (nc uint64, lastSeen time.Time, ok bool)
+	// Update records nc as the latest nonce-count seen for nonce.
+	Update(nonce string, nc uint64)
+	// Add registers a newly issued nonce with nc=0.
+	Add(nonce string)
+	// Purge evicts roughly n of the oldest tracked nonces.
+	Purge(n int)
+	// Len reports how many nonces are currently tracked.
+	Len() int
+	// SelfBounding reports whether the store already enforces its own
+	// capacity (e.g. a strict LRU that evicts on every Add), so
+	// requireAuth/NewContext should not additionally trigger Purge via
+	// ClientCacheSize/ClientCacheTolerance, which was sized for the
+	// default store and would only fight the store's own eviction.
+	SelfBounding() bool
+}
+
+const clientStoreShards = 32
+
+// shardedClientStore is the default ClientStore: clients are bucketed by
+// a hash of their nonce into one of clientStoreShards buckets, each
+// guarded by its own sync.Mutex, so unrelated nonces never contend on the
+// same lock.
+type shardedClientStore struct {
+	shards [clientStoreShards]clientShard
+}
+
+type clientShard struct {
+	mutex   sync.Mutex
+	clients map[string]*digest_client
+}
+
+// NewClientStore returns the default ClientStore: nonces are bucketed
+// across clientStoreShards independently-locked shards, and Purge
+// evicts the globally oldest entries by sorting across all shards, the
+// same sort-and-truncate approach DigestAuth always used for its client
+// cache.
+func NewClientStore() ClientStore {
+	store := &shardedClientStore{}
+	for i := range store.shards {
+		store.shards[i].clients = map[string]*digest_client{}
+	}
+	return store
+}
+
+func (s *shardedClientStore) shard(nonce string) *clientShard {
+	h := fnv.New32a()
+	io.WriteString(h, nonce)
+	return &s.shards[h.Sum32()%clientStoreShards]
+}
+
+func (s *shardedClientStore) Add(nonce string) {
+	sh := s.shard(nonce)
+	sh.mutex.Lock()
+	sh.clients[nonce] = &digest_client{nc: 0, last_seen: time.Now().UnixNano()}
+	sh.mutex.Unlock()
+}
+
+func (s *shardedClientStore) Get(nonce string) (nc uint64, lastSeen time.Time, ok bool) {
+	sh := s.shard(nonce)
+	sh.mutex.Lock()
+	defer sh.mutex.Unlock()
+	client, ok := sh.clients[nonce]
+	if !ok {
+		return 0, time.Time{}, false
+	}
+	return client.nc, time.Unix(0, client.last_seen), true
+}
+
+func (s *shardedClientStore) Update(nonce string, nc uint64) {
+	sh := s.shard(nonce)
+	sh.mutex.Lock()
+	defer sh.mutex.Unlock()
+	client, ok := sh.clients[nonce]
+	if !ok {
+		client = &digest_client{}
+		sh.clients[nonce] = client
+	}
+	client.nc = nc
+	client.last_seen = time.Now().UnixNano()
+}
+
+func (s *shardedClientStore) Purge(n int) {
+	if n <= 0 {
+		return
+	}
+	entries := make([]digest_cache_entry, 0, n*2)
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.mutex.Lock()
+		for nonce, client := range sh.clients {
+			entries = append(entries, digest_cache_entry{nonce, client.last_seen})
+		}
+		sh.mutex.Unlock()
+	}
+	if n > len(entries) {
+		n = len(entries)
+	}
+	sort.Sort(digest_cache(entries))
+	for _, entry := range entries[:n] {
+		sh := s.shard(entry.nonce)
+		sh.mutex.Lock()
+		delete(sh.clients, entry.nonce)
+		sh.mutex.Unlock()
+	}
+}
+
+func (s *shardedClientStore) Len() int {
+	total := 0
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.mutex.Lock()
+		total += len(sh.clients)
+		sh.mutex.Unlock()
+	}
+	return total
+}
+
+// SelfBounding is false: shardedClientStore relies on the caller to
+// trigger Purge via ClientCacheSize/ClientCacheTolerance.
+func (s *shardedClientStore) SelfBounding() bool {
+	return false
+}
+
 type digest_cache_entry struct {
 	nonce     string
 	last_seen int64
@@ -65,21 +406,77 @@ func (c digest_cache) Swap(i, j int) {
 	c[i], c[j] = c[j], c[i]
 }
 
+// lruClientStore is a ClientStore with strict LRU eviction, backed by
+// groupcache/lru, rather than the default store's periodic
+// sort-and-truncate: the oldest entry is evicted as soon as Add would
+// exceed size.
+type lruClientStore struct {
+	mutex sync.Mutex
+	cache *lru.Cache
+}
+
+// NewLRUClientStore returns a ClientStore that never tracks more than
+// size nonces, evicting the least-recently-used one as soon as a new
+// nonce would exceed it.
+func NewLRUClientStore(size int) ClientStore {
+	return &lruClientStore{cache: lru.New(size)}
+}
+
+func (s *lruClientStore) Add(nonce string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.cache.Add(nonce, &digest_client{nc: 0, last_seen: time.Now().UnixNano()})
+}
+
+func (s *lruClientStore) Get(nonce string) (nc uint64, lastSeen time.Time, ok bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	v, ok := s.cache.Get(nonce)
+	if !ok {
+		return 0, time.Time{}, false
+	}
+	client := v.(*digest_client)
+	return client.nc, time.Unix(0, client.last_seen), true
+}
+
+func (s *lruClientStore) Update(nonce string, nc uint64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	client := &digest_client{}
+	if v, ok := s.cache.Get(nonce); ok {
+		client = v.(*digest_client)
+	}
+	client.nc = nc
+	client.last_seen = time.Now().UnixNano()
+	s.cache.Add(nonce, client)
+}
+
+func (s *lruClientStore) Purge(n int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for i := 0; i < n; i++ {
+		s.cache.RemoveOldest()
+	}
+}
+
+func (s *lruClientStore) Len() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.cache.Len()
+}
+
+// SelfBounding is true: lruClientStore evicts its own oldest entry as
+// soon as size is exceeded, so it never needs ClientCacheSize/
+// ClientCacheTolerance to trigger a Purge.
+func (s *lruClientStore) SelfBounding() bool {
+	return true
+}
+
 /*
- Purge, Remove count oldest entries from DigestAuth.clients
+ Purge, Remove count oldest entries tracked by DigestAuth.Store
 */
 func (da *DigestAuth) Purge(count int) {
-	da.mutex.Lock()
-	entries := make([]digest_cache_entry, 0, len(da.clients))
-	for nonce, client := range da.clients {
-		entries = append(entries, digest_cache_entry{nonce, client.last_seen})
-	}
-	cache := digest_cache(entries)
-	sort.Sort(cache)
-	for _, client := range cache[:count] {
-		delete(da.clients, client.nonce)
-	}
-	da.mutex.Unlock()
+	da.Store.Purge(count)
 }
 
 /*
@@ -87,27 +484,75 @@ func (da *DigestAuth) Purge(count int) {
  (or requires reauthentication).
 */
 func (da *DigestAuth) RequireAuth(w http.ResponseWriter, r *http.Request) {
-	da.mutex.RLock()
-	if len(da.clients) > da.ClientCacheSize+da.ClientCacheTolerance {
-		da.mutex.RUnlock()
+	da.requireAuth(w, r, false)
+}
+
+func (da *DigestAuth) requireAuth(w http.ResponseWriter, r *http.Request, stale bool) {
+	if !da.Store.SelfBounding() && da.Store.Len() > da.ClientCacheSize+da.ClientCacheTolerance {
 		da.Purge(da.ClientCacheTolerance * 2)
-	} else {
-		da.mutex.RUnlock()
 	}
-	nonce := RandomKey()
-
-	da.mutex.Lock()
-	da.clients[nonce] = &digest_client{nc: 0, last_seen: time.Now().UnixNano()}
-	da.mutex.Unlock()
+	nonce := da.Nonces.Issue()
 
-	da.mutex.RLock()
 	w.Header().Set(contentType, da.Headers.V().UnauthContentType)
-	w.Header().Set(da.Headers.V().Authenticate,
-		fmt.Sprintf(`Digest realm="%s", nonce="%s", opaque="%s", algorithm="%s", qop="auth"`,
-			da.Realm, nonce, da.Opaque, da.Algorithm))
+	for _, challenge := range da.challenges(nonce, stale) {
+		w.Header().Add(da.Headers.V().Authenticate, challenge)
+	}
 	w.WriteHeader(da.Headers.V().UnauthCode)
 	w.Write([]byte(da.Headers.V().UnauthResponse))
-	da.mutex.RUnlock()
+}
+
+// challenges renders one "Digest ..." challenge per configured algorithm,
+// suitable for a WWW-Authenticate header, so clients can negotiate the
+// strongest algorithm they support (RFC 7616 §3.7). stale is set when the
+// request being challenged carried an expired nonce, so well-behaved
+// clients retry silently with the new nonce instead of re-prompting the
+// user for credentials.
+func (da *DigestAuth) challenges(nonce string, stale bool) []string {
+	challenges := make([]string, 0, len(da.Algorithms))
+	for _, algorithm := range da.Algorithms {
+		challenge := fmt.Sprintf(`Digest realm="%s", nonce="%s", opaque="%s", algorithm="%s", qop="%s", charset="UTF-8"`,
+			da.Realm, nonce, da.Opaque, algorithm, strings.Join(da.QOP, ","))
+		if len(da.Users) > 0 {
+			challenge += `, userhash=true`
+		}
+		if stale {
+			challenge += `, stale=true`
+		}
+		challenges = append(challenges, challenge)
+	}
+	return challenges
+}
+
+// supportsQOP reports whether qop is one of the values configured in
+// da.QOP.
+func (da *DigestAuth) supportsQOP(qop string) bool {
+	for _, supported := range da.QOP {
+		if supported == qop {
+			return true
+		}
+	}
+	return false
+}
+
+// bufferAuthIntBody reads the request body, replacing r.Body with a fresh
+// copy so the wrapped handler can still read it, and returns H(body) for
+// use in a qop=auth-int HA2. It fails if the body exceeds
+// MaxAuthIntBodySize.
+func (da *DigestAuth) bufferAuthIntBody(r *http.Request, H func(string) string) (bodyHash string, ok bool) {
+	if r.Body == nil {
+		r.Body = io.NopCloser(bytes.NewReader(nil))
+		return H(""), true
+	}
+	buf, err := io.ReadAll(io.LimitReader(r.Body, da.MaxAuthIntBodySize+1))
+	r.Body.Close()
+	if err != nil {
+		return "", false
+	}
+	if int64(len(buf)) > da.MaxAuthIntBodySize {
+		return "", false
+	}
+	r.Body = io.NopCloser(bytes.NewReader(buf))
+	return H(string(buf)), true
 }
 
 /*
@@ -131,13 +576,23 @@ func DigestAuthParams(authorization string) map[string]string {
  Authentication-Info response header.
 */
 func (da *DigestAuth) CheckAuth(r *http.Request) (username string, authinfo *string) {
-	da.mutex.RLock()
-	defer da.mutex.RUnlock()
+	username, authinfo, _, _ = da.checkAuth(r)
+	return
+}
+
+// checkAuth is CheckAuth plus a stale flag and a tooLarge flag. stale is
+// set when the Authorization header carried a nonce that Nonces.Validate
+// rejected as expired, so the caller can ask the client to silently retry
+// (RFC 7616 §3.3) rather than re-prompting the user for credentials. It is
+// also set when PasswordVerifier is in use and HA1Cache has no entry for
+// the user. tooLarge is set when a qop=auth-int request body exceeded
+// MaxAuthIntBodySize, so the caller can respond 413 instead.
+func (da *DigestAuth) checkAuth(r *http.Request) (username string, authinfo *string, stale bool, tooLarge bool) {
 	username = ""
 	authinfo = nil
 	auth := DigestAuthParams(r.Header.Get(da.Headers.V().Authorization))
 	if auth == nil {
-		return "", nil
+		return "", nil, false, false
 	}
 	// RFC2617 Section 3.2.1 specifies that unset value of algorithm in
 	// WWW-Authenticate Response header should be treated as
@@ -151,14 +606,20 @@ func (da *DigestAuth) CheckAuth(r *http.Request) (username string, authinfo *str
 	if _, ok := auth["algorithm"]; !ok {
 		auth["algorithm"] = "MD5"
 	}
-	if da.Opaque != auth["opaque"] || auth["qop"] != "auth" {
-		return "", nil
+	if da.Opaque != auth["opaque"] || !da.supportsQOP(auth["qop"]) {
+		return "", nil, false, false
+	}
+
+	if issuedAt, ok := da.Nonces.Validate(auth["nonce"]); !ok {
+		return "", nil, !issuedAt.IsZero(), false
 	}
 
-	H, ok := algorithms[strings.ToUpper(auth["algorithm"])]
+	algorithm := strings.ToUpper(auth["algorithm"])
+	H, ok := algorithms[algorithm]
 	if !ok {
-		return "", nil
+		return "", nil, false, false
 	}
+	sess := strings.HasSuffix(algorithm, "-SESS")
 
 	// Check if the requested URI matches auth header
 	if r.RequestURI != auth["uri"] {
@@ -171,25 +632,74 @@ func (da *DigestAuth) CheckAuth(r *http.Request) (username string, authinfo *str
 		// TODO: make an option to allow only strict checking.
 		switch u, err := url.Parse(auth["uri"]); {
 		case err != nil:
-			return "", nil
+			return "", nil, false, false
 		case r.URL == nil:
-			return "", nil
+			return "", nil, false, false
 		case len(u.Path) > len(r.URL.Path):
-			return "", nil
+			return "", nil, false, false
 		case !strings.HasPrefix(r.URL.Path, u.Path):
-			return "", nil
+			return "", nil, false, false
 		}
 	}
 
-	HA1 := da.Secrets(auth["username"], da.Realm)
-	if da.PlainTextSecrets {
-		HA1 = H(auth["username"] + ":" + da.Realm + ":" + HA1)
+	username = auth["username"]
+	if auth["userhash"] == "true" {
+		u, found := da.lookupUserhash(H, algorithm, username)
+		if !found {
+			return "", nil, false, false
+		}
+		username = u
+	}
+
+	var HA1 string
+	if da.PasswordVerifier != nil {
+		// HA1 depends on the hash function, so a client negotiating a
+		// different algorithm from the same multi-challenge needs its
+		// own cache entry; -SESS variants share their base algorithm's
+		// HA1, only deriving further from it below.
+		baseAlgorithm := strings.TrimSuffix(algorithm, "-SESS")
+		ha1, ok := da.HA1Cache.Get(username, da.Realm, baseAlgorithm)
+		if !ok {
+			// Digest's challenge-response never carries a plaintext
+			// password, so a cache miss here cannot be verified: the
+			// HA1 has to be (re-)derived out of band by VerifyPassword.
+			// Respond stale=true rather than a plain failure; requests
+			// for this user keep getting stale=true until the
+			// application calls VerifyPassword once it recovers the
+			// plaintext, e.g. from a login form submitted over TLS.
+			return "", nil, true, false
+		}
+		HA1 = ha1
+	} else {
+		HA1 = da.Secrets(username, da.Realm)
+		if da.PlainTextSecrets {
+			HA1 = H(username + ":" + da.Realm + ":" + HA1)
+		}
+	}
+	if sess {
+		HA1 = H(HA1 + ":" + auth["nonce"] + ":" + auth["cnonce"])
+	}
+
+	// For qop=auth-int, HA2 folds in H(entity-body) (RFC 7616 §3.4.3); the
+	// request body is buffered and replaced so the wrapped handler can
+	// still read it.
+	var bodyHash string
+	if auth["qop"] == "auth-int" {
+		hash, ok := da.bufferAuthIntBody(r, H)
+		if !ok {
+			return "", nil, false, true
+		}
+		bodyHash = hash
 	}
+
 	HA2 := H(r.Method + ":" + auth["uri"])
+	if auth["qop"] == "auth-int" {
+		HA2 = H(r.Method + ":" + auth["uri"] + ":" + bodyHash)
+	}
 	KD := H(strings.Join([]string{HA1, auth["nonce"], auth["nc"], auth["cnonce"], auth["qop"], HA2}, ":"))
 
 	if subtle.ConstantTimeCompare([]byte(KD), []byte(auth["response"])) != 1 {
-		return "", nil
+		return "", nil, false, false
 	}
 
 	// At this point crypto checks are completed and validated.
@@ -197,24 +707,172 @@ func (da *DigestAuth) CheckAuth(r *http.Request) (username string, authinfo *str
 
 	nc, err := strconv.ParseUint(auth["nc"], 16, 64)
 	if err != nil {
-		return "", nil
+		return "", nil, false, false
 	}
 
-	if client, ok := da.clients[auth["nonce"]]; !ok {
-		return "", nil
-	} else {
-		if client.nc != 0 && client.nc >= nc && !da.IgnoreNonceCount {
-			return "", nil
-		}
-		client.nc = nc
-		client.last_seen = time.Now().UnixNano()
+	if prevNC, ok := da.NonceCounters.Get(auth["nonce"]); ok && prevNC != 0 && prevNC >= nc && !da.IgnoreNonceCount {
+		return "", nil, false, false
 	}
+	da.NonceCounters.Update(auth["nonce"], nc)
 
 	resp_HA2 := H(":" + auth["uri"])
+	if auth["qop"] == "auth-int" {
+		resp_HA2 = H(":" + auth["uri"] + ":" + bodyHash)
+	}
 	rspauth := H(strings.Join([]string{HA1, auth["nonce"], auth["nc"], auth["cnonce"], auth["qop"], resp_HA2}, ":"))
 
-	info := fmt.Sprintf(`qop="auth", rspauth="%s", cnonce="%s", nc="%s"`, rspauth, auth["cnonce"], auth["nc"])
-	return auth["username"], &info
+	info := fmt.Sprintf(`qop="%s", rspauth="%s", cnonce="%s", nc="%s"`, auth["qop"], rspauth, auth["cnonce"], auth["nc"])
+	return username, &info, false, false
+}
+
+// PasswordVerifier authenticates candidatePassword for user against a
+// stored hash (bcrypt, argon2, ...) and, on success, derives the HA1
+// digest for algorithm (the base algorithm, e.g. "SHA-256", never a
+// "-SESS" variant) that Digest authentication actually needs. It is
+// never called by CheckAuth/RequireAuth directly -- see VerifyPassword.
+type PasswordVerifier func(user, realm, algorithm, candidatePassword string) (ha1 string, ok bool)
+
+// HA1Cache stores HA1 digests derived by a PasswordVerifier, keyed by
+// (user, realm, algorithm) -- HA1 depends on the hash function, and a
+// single DigestAuth's Algorithms may list more than one simultaneously
+// -- so that Digest authentication rounds after the first do not need
+// the plaintext password or another bcrypt/argon2 compare.
+//
+// Security note: an HA1 is equivalent to a plaintext password for the
+// purposes of Digest authentication; whoever can read a cache entry can
+// authenticate as that user without ever producing the original
+// bcrypt/argon2 hash. Implementations backing this with anything other
+// than process memory (a file, a shared cache) must encrypt entries at
+// rest and restrict access accordingly.
+type HA1Cache interface {
+	Get(user, realm, algorithm string) (ha1 string, ok bool)
+	Set(user, realm, algorithm, ha1 string, ttl time.Duration)
+}
+
+type ha1CacheEntry struct {
+	ha1     string
+	expires time.Time
+}
+
+// inMemoryHA1Cache is the default HA1Cache: a process-local map guarded
+// by a mutex. Entries past their TTL are treated as absent and are
+// dropped lazily on the next Get for that key.
+type inMemoryHA1Cache struct {
+	mu      sync.Mutex
+	entries map[string]ha1CacheEntry
+}
+
+// NewHA1Cache returns the default in-memory HA1Cache.
+func NewHA1Cache() HA1Cache {
+	return &inMemoryHA1Cache{entries: make(map[string]ha1CacheEntry)}
+}
+
+func ha1CacheKey(user, realm, algorithm string) string {
+	return user + ":" + realm + ":" + algorithm
+}
+
+func (c *inMemoryHA1Cache) Get(user, realm, algorithm string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := ha1CacheKey(user, realm, algorithm)
+	entry, ok := c.entries[key]
+	if !ok {
+		return "", false
+	}
+	if !entry.expires.IsZero() && time.Now().After(entry.expires) {
+		delete(c.entries, key)
+		return "", false
+	}
+	return entry.ha1, true
+}
+
+func (c *inMemoryHA1Cache) Set(user, realm, algorithm, ha1 string, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry := ha1CacheEntry{ha1: ha1}
+	if ttl > 0 {
+		entry.expires = time.Now().Add(ttl)
+	}
+	c.entries[ha1CacheKey(user, realm, algorithm)] = entry
+}
+
+// VerifyPassword authenticates candidatePassword for user against
+// PasswordVerifier, once per distinct base algorithm in Algorithms, and
+// caches each derived HA1 in HA1Cache so the next Digest round for this
+// user succeeds without the plaintext regardless of which algorithm the
+// client negotiates. Call it once the plaintext has been obtained
+// through some channel other than the Digest handshake itself (a login
+// form submitted over TLS, for example) -- CheckAuth never sees a
+// plaintext password to verify directly.
+//
+// It reports whether candidatePassword was valid for every algorithm
+// checked; treat false the same as any other failed login.
+func (da *DigestAuth) VerifyPassword(user, candidatePassword string) bool {
+	if da.PasswordVerifier == nil {
+		return false
+	}
+	algorithms := da.ha1CacheAlgorithms()
+	if len(algorithms) == 0 {
+		return false
+	}
+	verified := true
+	for _, algorithm := range algorithms {
+		ha1, ok := da.PasswordVerifier(user, da.Realm, algorithm, candidatePassword)
+		if !ok {
+			verified = false
+			continue
+		}
+		da.HA1Cache.Set(user, da.Realm, algorithm, ha1, da.HA1CacheTTL)
+	}
+	return verified
+}
+
+// ha1CacheAlgorithms returns the distinct base algorithms ("-SESS"
+// variants share their base algorithm's HA1) that VerifyPassword needs
+// to derive and cache so that checkAuth can satisfy a request using any
+// algorithm in Algorithms.
+func (da *DigestAuth) ha1CacheAlgorithms() []string {
+	seen := make(map[string]bool, len(da.Algorithms))
+	algorithms := make([]string, 0, len(da.Algorithms))
+	for _, algorithm := range da.Algorithms {
+		base := strings.TrimSuffix(strings.ToUpper(algorithm), "-SESS")
+		if seen[base] {
+			continue
+		}
+		seen[base] = true
+		algorithms = append(algorithms, base)
+	}
+	return algorithms
+}
+
+// lookupUserhash resolves an RFC 7616 userhash=true username (which
+// carries H(username:realm) in place of the plaintext username) back to
+// the plaintext username, using an index built once per algorithm
+// (see userhashIndex) rather than rehashing every entry in Users on
+// every request. Returns false if Users is unset or no entry matches.
+func (da *DigestAuth) lookupUserhash(H func(string) string, algorithm, hashed string) (string, bool) {
+	user, found := da.userhashIndexFor(H, algorithm)[hashed]
+	return user, found
+}
+
+// userhashIndexFor returns the cached H(user:realm) -> user index for
+// algorithm, building and caching it on first use. Users is assumed not
+// to change after the index for a given algorithm has been built.
+func (da *DigestAuth) userhashIndexFor(H func(string) string, algorithm string) map[string]string {
+	da.userhashIndexMu.Lock()
+	defer da.userhashIndexMu.Unlock()
+	if index, ok := da.userhashIndex[algorithm]; ok {
+		return index
+	}
+	index := make(map[string]string, len(da.Users))
+	for _, u := range da.Users {
+		index[H(u+":"+da.Realm)] = u
+	}
+	if da.userhashIndex == nil {
+		da.userhashIndex = make(map[string]map[string]string)
+	}
+	da.userhashIndex[algorithm] = index
+	return index
 }
 
 /*
@@ -223,6 +881,11 @@ func (da *DigestAuth) CheckAuth(r *http.Request) (username string, authinfo *str
 const DefaultClientCacheSize = 1000
 const DefaultClientCacheTolerance = 100
 
+// DefaultMaxAuthIntBodySize is the default DigestAuth.MaxAuthIntBodySize:
+// the largest request body CheckAuth will buffer to verify a
+// qop=auth-int request.
+const DefaultMaxAuthIntBodySize = 10 << 20 // 10 MiB
+
 /*
  Wrap returns an Authenticator which uses HTTP Digest
  authentication. Arguments:
@@ -233,13 +896,14 @@ const DefaultClientCacheTolerance = 100
  realm as above.
 */
 func (da *DigestAuth) Wrap(wrapped AuthenticatedHandlerFunc) http.HandlerFunc {
-	da.mutex.RLock()
-	defer da.mutex.RUnlock()
-
 	return func(w http.ResponseWriter, r *http.Request) {
-		if username, authinfo := da.CheckAuth(r); username == "" {
-			da.RequireAuth(w, r)
-		} else {
+		username, authinfo, stale, tooLarge := da.checkAuth(r)
+		switch {
+		case tooLarge:
+			http.Error(w, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+		case username == "":
+			da.requireAuth(w, r, stale)
+		default:
 			ar := &AuthenticatedRequest{Request: *r, Username: username}
 			if authinfo != nil {
 				w.Header().Set(da.Headers.V().AuthInfo, *authinfo)
@@ -263,37 +927,42 @@ func (da *DigestAuth) JustCheck(wrapped http.HandlerFunc) http.HandlerFunc {
 
 // NewContext returns a context carrying authentication information for the request.
 func (da *DigestAuth) NewContext(ctx context.Context, r *http.Request) context.Context {
-	da.mutex.Lock()
-	username, authinfo := da.CheckAuth(r)
+	// A qop=auth-int body over MaxAuthIntBodySize surfaces the same as an
+	// unauthenticated request here, since NewContext has no response
+	// writer of its own to send a 413 through.
+	username, authinfo, stale, _ := da.checkAuth(r)
 	info := &Info{Username: username, ResponseHeaders: make(http.Header)}
 	if username != "" {
 		info.Authenticated = true
 		info.ResponseHeaders.Set(da.Headers.V().AuthInfo, *authinfo)
 	} else {
 		// return back digest WWW-Authenticate header
-		if len(da.clients) > da.ClientCacheSize+da.ClientCacheTolerance {
+		if !da.Store.SelfBounding() && da.Store.Len() > da.ClientCacheSize+da.ClientCacheTolerance {
 			da.Purge(da.ClientCacheTolerance * 2)
 		}
-		nonce := RandomKey()
-		da.clients[nonce] = &digest_client{nc: 0, last_seen: time.Now().UnixNano()}
-		info.ResponseHeaders.Set(da.Headers.V().Authenticate,
-			fmt.Sprintf(`Digest realm="%s", nonce="%s", opaque="%s", algorithm="%s", qop="auth"`,
-				da.Realm, nonce, da.Opaque, da.Algorithm))
+		nonce := da.Nonces.Issue()
+		for _, challenge := range da.challenges(nonce, stale) {
+			info.ResponseHeaders.Add(da.Headers.V().Authenticate, challenge)
+		}
 	}
-	da.mutex.Unlock()
 	return context.WithValue(ctx, infoKey, info)
 }
 
 // NewDigestAuthenticator generates a new DigestAuth object
 func NewDigestAuthenticator(realm string, secrets SecretProvider) *DigestAuth {
 	da := &DigestAuth{
-		Algorithm:            "MD5", // NOT RECOMMENDED according to RFC 7616
+		Algorithms:           []string{"MD5"}, // NOT RECOMMENDED according to RFC 7616
 		Opaque:               RandomKey(),
 		Realm:                realm,
 		Secrets:              secrets,
 		PlainTextSecrets:     false,
 		ClientCacheSize:      DefaultClientCacheSize,
 		ClientCacheTolerance: DefaultClientCacheTolerance,
-		clients:              map[string]*digest_client{}}
+		QOP:                  []string{"auth"},
+		MaxAuthIntBodySize:   DefaultMaxAuthIntBodySize}
+	da.Store = NewClientStore()
+	da.Nonces = &InMemoryNonceSource{da: da}
+	da.NonceCounters = da
+	da.HA1Cache = NewHA1Cache()
 	return da
 }
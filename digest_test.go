@@ -0,0 +1,413 @@
+package auth
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// digestAuthHeader builds a Digest Authorization header against da for
+// algorithm, computing HA2/response (and, for "-SESS" algorithms, the
+// H(HA1:nonce:cnonce) derivation) the same way checkAuth does. headerUsername
+// is whatever the client would put in the Authorization "username" field,
+// which is the real username unless the caller is simulating
+// userhash=true, in which case it's H(username:realm) and ha1 must still
+// be the real user's HA1.
+func digestAuthHeader(da *DigestAuth, headerUsername, algorithm, ha1, method, uri, qop, nonce, cnonce, nc, body string) string {
+	H := algorithms[strings.ToUpper(algorithm)]
+	if strings.HasSuffix(strings.ToUpper(algorithm), "-SESS") {
+		ha1 = H(ha1 + ":" + nonce + ":" + cnonce)
+	}
+	ha2 := H(method + ":" + uri)
+	if qop == "auth-int" {
+		ha2 = H(method + ":" + uri + ":" + H(body))
+	}
+	response := H(strings.Join([]string{ha1, nonce, nc, cnonce, qop, ha2}, ":"))
+	return fmt.Sprintf(
+		`Digest username="%s", realm="%s", nonce="%s", uri="%s", algorithm=%s, qop=%s, nc=%s, cnonce="%s", response="%s", opaque="%s"`,
+		headerUsername, da.Realm, nonce, uri, algorithm, qop, nc, cnonce, response, da.Opaque)
+}
+
+// assertStale fails the test unless one of w's response headers carries a
+// stale=true challenge.
+func assertStale(t *testing.T, w *httptest.ResponseRecorder) {
+	t.Helper()
+	for _, values := range w.Header() {
+		for _, v := range values {
+			if strings.Contains(v, "stale=true") {
+				return
+			}
+		}
+	}
+	t.Fatalf("expected a stale=true challenge in response headers, got %v", w.Header())
+}
+
+func newTestDigestAuth() (*DigestAuth, string) {
+	const (
+		realm    = "testrealm@host.com"
+		user     = "Mufasa"
+		password = "Circle Of Life"
+	)
+	ha1 := md5sum(user + ":" + realm + ":" + password)
+	secrets := func(u, r string) string {
+		if u == user && r == realm {
+			return ha1
+		}
+		return ""
+	}
+	da := NewDigestAuthenticator(realm, secrets)
+	da.QOP = []string{"auth", "auth-int"}
+	return da, ha1
+}
+
+// TestWrapQOPAuth exercises the plain qop=auth path end to end through
+// Wrap.
+func TestWrapQOPAuth(t *testing.T) {
+	da, ha1 := newTestDigestAuth()
+	const uri = "/dir/index.html"
+
+	nonce := da.Nonces.Issue()
+	authHeader := digestAuthHeader(da, "Mufasa", "MD5", ha1, "GET", uri, "auth", nonce, "0a4f113b", "00000001", "")
+
+	var gotUsername string
+	handler := func(w http.ResponseWriter, ar *AuthenticatedRequest) {
+		gotUsername = ar.Username
+		w.WriteHeader(http.StatusOK)
+	}
+
+	r := httptest.NewRequest("GET", uri, nil)
+	r.Header.Set("Authorization", authHeader)
+	w := httptest.NewRecorder()
+
+	da.Wrap(handler)(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if gotUsername != "Mufasa" {
+		t.Fatalf("handler saw username %q, want %q", gotUsername, "Mufasa")
+	}
+}
+
+// TestWrapQOPAuthInt exercises qop=auth-int through Wrap and asserts
+// that the wrapped handler can still read the original request body
+// after CheckAuth has buffered it to verify entity-body integrity.
+func TestWrapQOPAuthInt(t *testing.T) {
+	da, ha1 := newTestDigestAuth()
+	const (
+		uri      = "/dir/index.html"
+		bodyText = "hello from the client"
+	)
+
+	nonce := da.Nonces.Issue()
+	authHeader := digestAuthHeader(da, "Mufasa", "MD5", ha1, "POST", uri, "auth-int", nonce, "0a4f113b", "00000001", bodyText)
+
+	var gotBody string
+	handler := func(w http.ResponseWriter, ar *AuthenticatedRequest) {
+		b, err := io.ReadAll(ar.Body)
+		if err != nil {
+			t.Fatalf("handler could not read body: %v", err)
+		}
+		gotBody = string(b)
+		w.WriteHeader(http.StatusOK)
+	}
+
+	r := httptest.NewRequest("POST", uri, strings.NewReader(bodyText))
+	r.Header.Set("Authorization", authHeader)
+	w := httptest.NewRecorder()
+
+	da.Wrap(handler)(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if gotBody != bodyText {
+		t.Fatalf("handler read body %q, want %q", gotBody, bodyText)
+	}
+}
+
+// TestHA1CacheKeyedByAlgorithm drives VerifyPassword/CheckAuth with
+// Algorithms set to both SHA-256 and its -SESS variant, and asserts that
+// HA1Cache keys by (user, realm, algorithm): a request is stale=true
+// before VerifyPassword warms the cache, PasswordVerifier is invoked
+// exactly once per distinct base algorithm (not once per -SESS variant),
+// and both algorithms succeed off the single cached base-algorithm entry
+// afterwards.
+func TestHA1CacheKeyedByAlgorithm(t *testing.T) {
+	const (
+		realm    = "testrealm@host.com"
+		user     = "Mufasa"
+		password = "Circle Of Life"
+	)
+	verifierCalls := map[string]int{}
+	da := NewDigestAuthenticator(realm, func(u, r string) string { return "" })
+	da.Algorithms = []string{"SHA-256", "SHA-256-SESS"}
+	da.QOP = []string{"auth"}
+	da.PasswordVerifier = func(u, r, algorithm, candidate string) (string, bool) {
+		if u != user || r != realm || candidate != password {
+			return "", false
+		}
+		verifierCalls[algorithm]++
+		return sha256sum(u + ":" + r + ":" + candidate), true
+	}
+	ha1 := sha256sum(user + ":" + realm + ":" + password)
+
+	// Before VerifyPassword ever runs, HA1Cache has nothing cached, so
+	// even a correctly computed response must come back stale=true
+	// rather than succeeding or failing silently.
+	nonce := da.Nonces.Issue()
+	header := digestAuthHeader(da, user, "SHA-256", ha1, "GET", "/", "auth", nonce, "cnonce1", "00000001", "")
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", header)
+	w := httptest.NewRecorder()
+	da.Wrap(func(w http.ResponseWriter, ar *AuthenticatedRequest) {
+		t.Fatal("handler should not run before VerifyPassword warms HA1Cache")
+	})(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 before HA1Cache is warmed, got %d", w.Code)
+	}
+	assertStale(t, w)
+
+	if !da.VerifyPassword(user, password) {
+		t.Fatal("VerifyPassword should succeed")
+	}
+	if verifierCalls["SHA-256"] != 1 {
+		t.Fatalf("expected PasswordVerifier called once for base algorithm SHA-256, got %d", verifierCalls["SHA-256"])
+	}
+	if calls := verifierCalls["SHA-256-SESS"]; calls != 0 {
+		t.Fatalf("PasswordVerifier should only be called with base algorithms, got %d calls for SHA-256-SESS", calls)
+	}
+
+	// Both SHA-256 and SHA-256-SESS now succeed from the single cached
+	// base-algorithm HA1 entry.
+	for _, algorithm := range []string{"SHA-256", "SHA-256-SESS"} {
+		nonce := da.Nonces.Issue()
+		header := digestAuthHeader(da, user, algorithm, ha1, "GET", "/", "auth", nonce, "cnonce2", "00000001", "")
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Authorization", header)
+		w := httptest.NewRecorder()
+		var gotUsername string
+		da.Wrap(func(w http.ResponseWriter, ar *AuthenticatedRequest) {
+			gotUsername = ar.Username
+			w.WriteHeader(http.StatusOK)
+		})(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("algorithm %s: expected 200, got %d: %s", algorithm, w.Code, w.Body.String())
+		}
+		if gotUsername != user {
+			t.Fatalf("algorithm %s: handler saw username %q, want %q", algorithm, gotUsername, user)
+		}
+	}
+}
+
+// TestHA1CacheTTLExpiryIsStale asserts that once an HA1Cache entry passes
+// HA1CacheTTL, checkAuth treats it as a cache miss again (stale=true)
+// rather than continuing to authenticate off a stale entry.
+func TestHA1CacheTTLExpiryIsStale(t *testing.T) {
+	const (
+		realm    = "testrealm@host.com"
+		user     = "Mufasa"
+		password = "Circle Of Life"
+	)
+	da := NewDigestAuthenticator(realm, func(u, r string) string { return "" })
+	da.Algorithms = []string{"SHA-256"}
+	da.QOP = []string{"auth"}
+	da.HA1CacheTTL = time.Millisecond
+	da.PasswordVerifier = func(u, r, algorithm, candidate string) (string, bool) {
+		return sha256sum(u + ":" + r + ":" + candidate), true
+	}
+	if !da.VerifyPassword(user, password) {
+		t.Fatal("VerifyPassword should succeed")
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	ha1 := sha256sum(user + ":" + realm + ":" + password)
+	nonce := da.Nonces.Issue()
+	header := digestAuthHeader(da, user, "SHA-256", ha1, "GET", "/", "auth", nonce, "cnonce", "00000001", "")
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", header)
+	w := httptest.NewRecorder()
+	da.Wrap(func(w http.ResponseWriter, ar *AuthenticatedRequest) {
+		t.Fatal("handler should not run once the HA1Cache entry has expired")
+	})(w, r)
+
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 once HA1Cache entry has expired, got %d", w.Code)
+	}
+	assertStale(t, w)
+}
+
+// TestWrapSHA256Algorithm exercises a non-MD5 algorithm end to end
+// through Wrap.
+func TestWrapSHA256Algorithm(t *testing.T) {
+	const (
+		realm    = "testrealm@host.com"
+		user     = "Mufasa"
+		password = "Circle Of Life"
+	)
+	da := NewDigestAuthenticator(realm, func(u, r string) string { return password })
+	da.PlainTextSecrets = true
+	da.Algorithms = []string{"SHA-256"}
+	da.QOP = []string{"auth"}
+
+	ha1 := sha256sum(user + ":" + realm + ":" + password)
+	nonce := da.Nonces.Issue()
+	header := digestAuthHeader(da, user, "SHA-256", ha1, "GET", "/", "auth", nonce, "0a4f113b", "00000001", "")
+
+	var gotUsername string
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", header)
+	w := httptest.NewRecorder()
+	da.Wrap(func(w http.ResponseWriter, ar *AuthenticatedRequest) {
+		gotUsername = ar.Username
+		w.WriteHeader(http.StatusOK)
+	})(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if gotUsername != user {
+		t.Fatalf("handler saw username %q, want %q", gotUsername, user)
+	}
+}
+
+// TestWrapSHA256SessAlgorithm exercises a "-SESS" algorithm end to end
+// through Wrap. digestAuthHeader computes its response from
+// H(HA1:nonce:cnonce) rather than the base HA1 (RFC 7616 §3.4.2); if
+// checkAuth stopped applying that derivation, the response would no
+// longer match and this test would start failing with 401 instead of
+// silently accepting the wrong HA1.
+func TestWrapSHA256SessAlgorithm(t *testing.T) {
+	const (
+		realm    = "testrealm@host.com"
+		user     = "Mufasa"
+		password = "Circle Of Life"
+	)
+	da := NewDigestAuthenticator(realm, func(u, r string) string { return password })
+	da.PlainTextSecrets = true
+	da.Algorithms = []string{"SHA-256-SESS"}
+	da.QOP = []string{"auth"}
+
+	ha1 := sha256sum(user + ":" + realm + ":" + password)
+	nonce := da.Nonces.Issue()
+	header := digestAuthHeader(da, user, "SHA-256-SESS", ha1, "GET", "/", "auth", nonce, "0a4f113b", "00000001", "")
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", header)
+	w := httptest.NewRecorder()
+	da.Wrap(func(w http.ResponseWriter, ar *AuthenticatedRequest) {
+		w.WriteHeader(http.StatusOK)
+	})(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200 with correct H(HA1:nonce:cnonce) sess derivation, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+// TestWrapUserhash exercises a userhash=true request, where the
+// Authorization header's username field carries H(username:realm)
+// instead of the plaintext username, resolved back via Users.
+func TestWrapUserhash(t *testing.T) {
+	const (
+		realm    = "testrealm@host.com"
+		user     = "Mufasa"
+		password = "Circle Of Life"
+	)
+	da := NewDigestAuthenticator(realm, func(u, r string) string { return password })
+	da.PlainTextSecrets = true
+	da.Algorithms = []string{"MD5"}
+	da.QOP = []string{"auth"}
+	da.Users = []string{user}
+
+	ha1 := md5sum(user + ":" + realm + ":" + password)
+	hashedUsername := md5sum(user + ":" + realm)
+	nonce := da.Nonces.Issue()
+	header := digestAuthHeader(da, hashedUsername, "MD5", ha1, "GET", "/", "auth", nonce, "0a4f113b", "00000001", "")
+	header += `, userhash=true`
+
+	var gotUsername string
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", header)
+	w := httptest.NewRecorder()
+	da.Wrap(func(w http.ResponseWriter, ar *AuthenticatedRequest) {
+		gotUsername = ar.Username
+		w.WriteHeader(http.StatusOK)
+	})(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if gotUsername != user {
+		t.Fatalf("handler resolved username %q, want %q", gotUsername, user)
+	}
+}
+
+// TestSignedNonceSourceRoundTrip issues a nonce and validates it
+// immediately, as a process-restart-surviving SignedNonceSource must.
+func TestSignedNonceSourceRoundTrip(t *testing.T) {
+	s := &SignedNonceSource{Secret: []byte("test-secret"), Opaque: "test-opaque"}
+	nonce := s.Issue()
+	if _, ok := s.Validate(nonce); !ok {
+		t.Fatalf("freshly issued nonce failed to validate")
+	}
+}
+
+// TestSignedNonceSourceRejectsTamperedNonce flips a bit in an issued
+// nonce's HMAC and asserts Validate rejects the forged result.
+func TestSignedNonceSourceRejectsTamperedNonce(t *testing.T) {
+	s := &SignedNonceSource{Secret: []byte("test-secret"), Opaque: "test-opaque"}
+	nonce := s.Issue()
+	raw, err := base64.RawURLEncoding.DecodeString(nonce)
+	if err != nil {
+		t.Fatalf("could not decode issued nonce: %v", err)
+	}
+	raw[len(raw)-1] ^= 0xff
+	tampered := base64.RawURLEncoding.EncodeToString(raw)
+
+	if _, ok := s.Validate(tampered); ok {
+		t.Fatalf("tampered nonce validated successfully")
+	}
+}
+
+// TestSignedNonceSourceMaxAgeExpiryIsStale asserts that a nonce older
+// than MaxAge is rejected by Validate and, driven through Wrap, yields
+// a stale=true challenge rather than a plain 401.
+func TestSignedNonceSourceMaxAgeExpiryIsStale(t *testing.T) {
+	const (
+		realm    = "testrealm@host.com"
+		user     = "Mufasa"
+		password = "Circle Of Life"
+	)
+	da := NewDigestAuthenticator(realm, func(u, r string) string { return password })
+	da.PlainTextSecrets = true
+	da.Algorithms = []string{"MD5"}
+	da.QOP = []string{"auth"}
+	nonces := &SignedNonceSource{Secret: []byte("test-secret"), Opaque: da.Opaque, MaxAge: time.Millisecond}
+	da.Nonces = nonces
+
+	nonce := nonces.Issue()
+	time.Sleep(10 * time.Millisecond)
+
+	if _, ok := nonces.Validate(nonce); ok {
+		t.Fatalf("nonce older than MaxAge validated successfully")
+	}
+
+	ha1 := md5sum(user + ":" + realm + ":" + password)
+	header := digestAuthHeader(da, user, "MD5", ha1, "GET", "/", "auth", nonce, "0a4f113b", "00000001", "")
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", header)
+	w := httptest.NewRecorder()
+	da.Wrap(func(w http.ResponseWriter, ar *AuthenticatedRequest) {
+		t.Fatal("handler should not run for a nonce older than MaxAge")
+	})(w, r)
+
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for an expired nonce, got %d", w.Code)
+	}
+	assertStale(t, w)
+}